@@ -0,0 +1,39 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffHandler implements exponential backoff with jitter for retrying
+// pipe dials, mirroring cloudflared's origin/backoffhandler: each failure
+// doubles the interval (capped at MaxInterval), and the wait returned is a
+// random duration between half and all of that interval, so a fleet of
+// clients reconnecting after a server blip doesn't do so in lockstep.
+type BackoffHandler struct {
+	BaseInterval time.Duration
+	MaxInterval  time.Duration
+	MaxRetries   int // 0 means unlimited
+
+	retries int
+}
+
+// Backoff returns the duration to wait before the next retry, and false
+// once MaxRetries has been exceeded (never, when MaxRetries is 0).
+func (b *BackoffHandler) Backoff() (time.Duration, bool) {
+	if b.MaxRetries > 0 && b.retries >= b.MaxRetries {
+		return 0, false
+	}
+	interval := b.BaseInterval << uint(b.retries)
+	if interval <= 0 || interval > b.MaxInterval {
+		interval = b.MaxInterval
+	}
+	b.retries++
+	jitter := time.Duration(rand.Int63n(int64(interval)/2 + 1))
+	return interval/2 + jitter, true
+}
+
+// Reset clears the retry count, called after a successful dial.
+func (b *BackoffHandler) Reset() {
+	b.retries = 0
+}
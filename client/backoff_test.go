@@ -0,0 +1,48 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffHandlerCapsAtMaxInterval(t *testing.T) {
+	b := &BackoffHandler{BaseInterval: time.Second, MaxInterval: time.Second * 10}
+	for i := 0; i < 10; i++ {
+		wait, ok := b.Backoff()
+		if !ok {
+			t.Fatalf("Backoff() returned ok=false before MaxRetries was set")
+		}
+		if wait > b.MaxInterval {
+			t.Fatalf("Backoff() returned %v, want <= MaxInterval %v", wait, b.MaxInterval)
+		}
+		if wait < 0 {
+			t.Fatalf("Backoff() returned negative duration %v", wait)
+		}
+	}
+}
+
+func TestBackoffHandlerMaxRetries(t *testing.T) {
+	b := &BackoffHandler{BaseInterval: time.Millisecond, MaxInterval: time.Second, MaxRetries: 3}
+	for i := 0; i < 3; i++ {
+		if _, ok := b.Backoff(); !ok {
+			t.Fatalf("Backoff() retry %d: got ok=false, want true", i)
+		}
+	}
+	if _, ok := b.Backoff(); ok {
+		t.Fatalf("Backoff() after MaxRetries exceeded: got ok=true, want false")
+	}
+}
+
+func TestBackoffHandlerReset(t *testing.T) {
+	b := &BackoffHandler{BaseInterval: time.Millisecond, MaxInterval: time.Second, MaxRetries: 1}
+	if _, ok := b.Backoff(); !ok {
+		t.Fatalf("Backoff() first call: got ok=false, want true")
+	}
+	if _, ok := b.Backoff(); ok {
+		t.Fatalf("Backoff() should be exhausted before Reset")
+	}
+	b.Reset()
+	if _, ok := b.Backoff(); !ok {
+		t.Fatalf("Backoff() after Reset: got ok=false, want true")
+	}
+}
@@ -24,6 +24,11 @@ import (
 var pingInterval time.Duration = time.Second * 30
 var pingTimeout time.Duration = time.Second * 70
 
+// adminOnce guards the process-wide log sink and metrics server so they
+// get set up exactly once even if the client reconnects and builds a new
+// Control.
+var adminOnce sync.Once
+
 func NewControl(conn net.Conn, encryptMode string, transport string) *Control {
 	ctl := &Control{
 		ctlConn:       conn,
@@ -34,6 +39,7 @@ func NewControl(conn net.Conn, encryptMode string, transport string) *Control {
 		tunnels:       make(map[string]msg.TunnelConfig, 0),
 		transportMode: transport,
 	}
+	ctl.pool = newPipePool(ctl)
 	return ctl
 }
 
@@ -50,7 +56,8 @@ type Control struct {
 	lastRead        uint64
 	encryptMode     string
 	transportMode   string
-	totalPipes      int64
+	lastPingSent    int64
+	pool            *pipePool
 
 	die       chan struct{}
 	toDie     chan struct{}
@@ -60,9 +67,18 @@ type Control struct {
 }
 
 func (c *Control) Close() {
+	log.WithField("time", time.Now().UnixNano()).Debugln("control closing gracefully")
+	select {
+	case c.writeChan <- writeReq{msg.TypeShutdown, nil}:
+	default:
+		log.Warningln("control closing: writeChan full, skipping TypeShutdown notice")
+	}
+	grace := cliConf.ShutdownGracePeriod
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	c.pool.drain(grace)
 	c.toDie <- struct{}{}
-	log.WithField("time", time.Now().UnixNano()).Debugln("control closing")
-	return
 }
 
 func (c *Control) IsClosed() bool {
@@ -80,105 +96,85 @@ func (c *Control) moderator() {
 	c.ctlConn.Close()
 }
 
-func (c *Control) createPipe() {
-	log.WithFields(log.Fields{"time": time.Now().Unix(), "pipe_count": atomic.LoadInt64(&c.totalPipes)}).Debugln("create pipe to server!")
-	pipeConn, err := transport.CreateConn(cliConf.ServerAddr, c.transportMode, cliConf.HttpProxy)
-	if err != nil {
-		log.WithFields(log.Fields{"addr": cliConf.ServerAddr, "err": err}).Errorln("creating tunnel conn to server failed!")
+// dispatchStream dials the local service for stream's tunnel and pipes
+// data between them until either side is done. It used to live inline in
+// createPipe's accept loop; the pipe pool now owns accepting streams off
+// pooled sessions and calls this for each one.
+func (c *Control) dispatchStream(stream transport.Stream) {
+	defer stream.Close()
+	c.tunnelLock.Lock()
+	tunnel, isok := c.tunnels[stream.TunnelName()]
+	c.tunnelLock.Unlock()
+	if !isok {
+		log.WithFields(log.Fields{"name": stream.TunnelName()}).Errorln("can't find tunnel by name")
 		return
 	}
-	defer pipeConn.Close()
-
-	pipe, err := c.pipeHandShake(pipeConn)
+	if tunnel.Protocol == "http" || tunnel.Protocol == "https" {
+		c.serveHTTPTunnel(stream, tunnel)
+		return
+	}
+	var conn net.Conn
+	localProto, hostname, port, err := util.ParseLocalAddr(tunnel.LocalAddr)
 	if err != nil {
-		pipeConn.Close()
-		log.WithFields(log.Fields{"err": err}).Errorln("pipeHandShake failed!")
+		log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Errorln("util.ParseLocalAddr failed!")
 		return
 	}
-	defer pipe.Close()
-	atomic.AddInt64(&c.totalPipes, 1)
-	defer func() {
-		log.WithFields(log.Fields{"pipe_count": atomic.LoadInt64(&c.totalPipes)}).Debugln("total pipe count")
-		atomic.AddInt64(&c.totalPipes, -1)
-	}()
-	for {
-		if c.IsClosed() {
+	if localProto == "http" || localProto == "https" || localProto == "" {
+		if port == "" {
+			if localProto == "https" {
+				port = "443"
+			} else {
+				port = "80"
+			}
+		}
+		conn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", hostname, port))
+		if err != nil {
+			metricDialFailures.WithLabelValues(stream.TunnelName()).Inc()
+			log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
 			return
 		}
-		if pipe.IsClosed() {
+		if tunnel.Protocol == "https" {
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+	} else if localProto == "unix" {
+		conn, err = net.Dial("unix", hostname)
+		if err != nil {
+			metricDialFailures.WithLabelValues(stream.TunnelName()).Inc()
+			log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
 			return
 		}
-		stream, err := pipe.AcceptStream()
+	} else {
+		if port == "" {
+			log.WithFields(log.Fields{"err": fmt.Sprintf("no port sepicified"), "local": tunnel.LocalAddr}).Errorln("dial local addr failed!")
+			return
+		}
+		conn, err = net.Dial(localProto, hostname)
 		if err != nil {
-			log.WithFields(log.Fields{"err": err, "time": time.Now().Unix()}).Warningln("pipeAcceptStream failed!")
+			metricDialFailures.WithLabelValues(stream.TunnelName()).Inc()
+			log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
 			return
 		}
-		go func() {
-			defer stream.Close()
-			c.tunnelLock.Lock()
-			tunnel, isok := c.tunnels[stream.TunnelName()]
-			c.tunnelLock.Unlock()
-			if !isok {
-				log.WithFields(log.Fields{"name": stream.TunnelName()}).Errorln("can't find tunnel by name")
-				return
-			}
-			var conn net.Conn
-			localProto, hostname, port, err := util.ParseLocalAddr(tunnel.LocalAddr)
-			if err != nil {
-				log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Errorln("util.ParseLocalAddr failed!")
-				return
-			}
-			if localProto == "http" || localProto == "https" || localProto == "" {
-				if port == "" {
-					if localProto == "https" {
-						port = "443"
-					} else {
-						port = "80"
-					}
-				}
-				conn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", hostname, port))
-				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
-					return
-				}
-				if tunnel.Protocol == "https" {
-					conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
-				}
-			} else if localProto == "unix" {
-				conn, err = net.Dial("unix", hostname)
-				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
-					return
-				}
-			} else {
-				if port == "" {
-					log.WithFields(log.Fields{"err": fmt.Sprintf("no port sepicified"), "local": tunnel.LocalAddr}).Errorln("dial local addr failed!")
-					return
-				}
-				conn, err = net.Dial(localProto, hostname)
-				if err != nil {
-					log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Warningln("pipe dial local failed!")
-					return
-				}
-			}
-			defer conn.Close()
-
-			p1die := make(chan struct{})
-			p2die := make(chan struct{})
-
-			go func() {
-				io.Copy(stream, conn)
-				close(p1die)
-			}()
-			go func() {
-				io.Copy(conn, stream)
-				close(p2die)
-			}()
-			select {
-			case <-p1die:
-			case <-p2die:
-			}
-		}()
+	}
+	conn = newCountConn(conn, stream.TunnelName())
+	defer conn.Close()
+
+	metricActiveStreams.WithLabelValues(stream.TunnelName()).Inc()
+	defer metricActiveStreams.WithLabelValues(stream.TunnelName()).Dec()
+
+	p1die := make(chan struct{})
+	p2die := make(chan struct{})
+
+	go func() {
+		io.Copy(stream, conn)
+		close(p1die)
+	}()
+	go func() {
+		io.Copy(conn, stream)
+		close(p2die)
+	}()
+	select {
+	case <-p1die:
+	case <-p2die:
 	}
 }
 
@@ -218,10 +214,13 @@ func (c *Control) recvLoop() {
 		atomic.StoreUint64(&c.lastRead, uint64(time.Now().UnixNano()))
 		switch mType {
 		case msg.TypePong:
+			if sentAt := atomic.SwapInt64(&c.lastPingSent, 0); sentAt != 0 {
+				metricPingRTT.Observe(time.Since(time.Unix(0, sentAt)).Seconds())
+			}
 		case msg.TypePing:
 			c.writeChan <- writeReq{msg.TypePong, nil}
 		case msg.TypePipeReq:
-			go c.createPipe()
+			go c.pool.growIfBusy()
 		case msg.TypeAddTunnels:
 			c.SyncTunnels(body.(*msg.AddTunnels))
 		case msg.TypeError:
@@ -274,10 +273,20 @@ func (c *Control) listenAndStop() {
 }
 
 func (c *Control) Run() {
+	adminOnce.Do(func() {
+		if err := setupLogSink(cliConf.Log); err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("setup log sink failed")
+		}
+		if err := StartMetricsServer(cliConf.MetricsAddr); err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("start metrics server failed")
+		}
+	})
 	go c.moderator()
 	go c.recvLoop()
 	go c.writeLoop()
 	go c.listenAndStop()
+	go c.listenForReload()
+	go c.pool.run()
 
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
@@ -289,6 +298,7 @@ func (c *Control) Run() {
 				c.Close()
 				return
 			}
+			atomic.StoreInt64(&c.lastPingSent, time.Now().UnixNano())
 			select {
 			case c.writeChan <- writeReq{msg.TypePing, nil}:
 			case _ = <-c.die:
@@ -337,7 +347,14 @@ func (c *Control) ClientHandShake() error {
 	return nil
 }
 
-func (c *Control) pipeHandShake(conn net.Conn) (*smux.Session, error) {
+func (c *Control) pipeHandShake(conn net.Conn) (transport.Session, error) {
+	if c.transportMode == "h2mux" {
+		return c.h2muxHandShake(conn)
+	}
+	if c.transportMode == "cloak" {
+		return c.cloakHandShake(conn)
+	}
+
 	var phs msg.PipeClientHello
 	phs.Once = crypto.GenUUID()
 	phs.ClientID = c.ClientID
@@ -368,5 +385,74 @@ func (c *Control) pipeHandShake(conn net.Conn) (*smux.Session, error) {
 		}
 	}
 
-	return mux, nil
+	return smuxSession{mux}, nil
+}
+
+// h2muxHandShake wraps conn in TLS (ALPN "h2") before sending the pipe
+// handshake message, then hands the TLS conn to an H2MuxSession so
+// tunneled connections travel as HTTP/2 streams. This is what lets the
+// pipe pass through CDNs/proxies that only forward HTTPS: on the wire it
+// is indistinguishable from a normal HTTP/2 connection.
+func (c *Control) h2muxHandShake(conn net.Conn) (transport.Session, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: cliConf.ServerName,
+		NextProtos: []string{"h2"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "h2mux tls handshake")
+	}
+
+	var phs msg.PipeClientHello
+	phs.Once = crypto.GenUUID()
+	phs.ClientID = c.ClientID
+	if err := msg.WriteMsg(tlsConn, msg.TypePipeClientHello, phs); err != nil {
+		return nil, errors.Wrap(err, "write pipe handshake")
+	}
+
+	sess, err := transport.NewH2MuxClient(tlsConn)
+	if err != nil {
+		return nil, errors.Wrap(err, "transport.NewH2MuxClient")
+	}
+	return sess, nil
+}
+
+// cloakHandShake disguises the pipe as a genuine TLS ClientHello/ServerHello
+// exchange to an arbitrary SNI, deriving the master key from an X25519
+// exchange hidden inside those messages, then hands off to the same
+// crypto.NewCryptoConn + smux pairing the encrypted tcp/kcp modes use.
+func (c *Control) cloakHandShake(conn net.Conn) (transport.Session, error) {
+	masterKey, err := transport.CloakHandshakeClient(conn, transport.CloakParams{
+		SNI:          cliConf.Cloak.SNI,
+		TemplatePath: cliConf.Cloak.ClientHelloTemplate,
+		ClientID:     c.ClientID,
+		Once:         crypto.GenUUID(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cloak handshake")
+	}
+	cryptoConn, err := crypto.NewCryptoConn(conn, masterKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypto.NewCryptoConn")
+	}
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.MaxReceiveBuffer = 4194304
+	mux, err := smux.Server(cryptoConn, smuxConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "smux.Server")
+	}
+	return smuxSession{mux}, nil
+}
+
+// smuxSession adapts *smux.Session to transport.Session so the pipe pool
+// can treat the smux and h2mux pipe transports identically.
+type smuxSession struct {
+	*smux.Session
+}
+
+func (s smuxSession) OpenStream(tunnelName string) (transport.Stream, error) {
+	return nil, errors.New("smux pipe does not support client-initiated streams")
+}
+
+func (s smuxSession) AcceptStream() (transport.Stream, error) {
+	return s.Session.AcceptStream()
 }
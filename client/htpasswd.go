@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	htpasswdMu    sync.Mutex
+	htpasswdCache = make(map[string]*htpasswdAuth)
+)
+
+// getHtpasswdAuth returns the (cached, self-reloading) credential store
+// for path, loading it the first time it's referenced by a tunnel's
+// AuthFile so multiple tunnels sharing one htpasswd file share one
+// watcher instead of polling the file redundantly.
+func getHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	htpasswdMu.Lock()
+	defer htpasswdMu.Unlock()
+	if a, ok := htpasswdCache[path]; ok {
+		return a, nil
+	}
+	a, err := newHtpasswdAuth(path)
+	if err != nil {
+		return nil, err
+	}
+	htpasswdCache[path] = a
+	return a, nil
+}
+
+// htpasswdAuth checks Basic auth credentials against an Apache-style
+// htpasswd file, supporting bcrypt, {SHA} and plaintext entries like
+// dumbproxy's BasicAuth. It polls the file's mtime and reloads on change
+// so rotating credentials doesn't require restarting the client.
+type htpasswdAuth struct {
+	path string
+
+	mu      sync.RWMutex
+	creds   map[string]string
+	modTime time.Time
+}
+
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	a := &htpasswdAuth{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	go a.watch()
+	return a, nil
+}
+
+func (a *htpasswdAuth) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return errors.Wrap(err, "stat htpasswd file")
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return errors.Wrap(err, "open htpasswd file")
+	}
+	defer f.Close()
+
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		creds[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "scan htpasswd file")
+	}
+
+	a.mu.Lock()
+	a.creds = creds
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *htpasswdAuth) watch() {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(a.path)
+		if err != nil {
+			log.WithFields(log.Fields{"path": a.path, "err": err}).Warningln("htpasswd: stat failed")
+			continue
+		}
+		a.mu.RLock()
+		changed := info.ModTime().After(a.modTime)
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := a.reload(); err != nil {
+			log.WithFields(log.Fields{"path": a.path, "err": err}).Warningln("htpasswd: reload failed")
+			continue
+		}
+		log.WithFields(log.Fields{"path": a.path}).Infoln("htpasswd: reloaded credentials")
+	}
+}
+
+// Authenticate reports whether user/pass matches an entry in the file,
+// supporting the three hash formats htpasswd commonly produces.
+func (a *htpasswdAuth) Authenticate(user, pass string) bool {
+	a.mu.RLock()
+	hash, ok := a.creds[user]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash), []byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(pass)) == 1
+	}
+}
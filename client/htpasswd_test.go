@@ -0,0 +1,61 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswdFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatalf("create temp htpasswd file: %v", err)
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("write temp htpasswd file: %v", err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("generate bcrypt hash: %v", err)
+	}
+	shaSum := sha1.Sum([]byte("shapass"))
+	shaHash := "{SHA}" + base64.StdEncoding.EncodeToString(shaSum[:])
+
+	path := writeHtpasswdFile(t, "bcryptuser:"+string(bcryptHash)+"\n"+
+		"shauser:"+shaHash+"\n"+
+		"plainuser:plainpass\n"+
+		"# a comment\n\n")
+	defer os.Remove(path)
+
+	a := &htpasswdAuth{path: path}
+	if err := a.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	cases := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"bcryptuser", "bcryptpass", true},
+		{"bcryptuser", "wrong", false},
+		{"shauser", "shapass", true},
+		{"shauser", "wrong", false},
+		{"plainuser", "plainpass", true},
+		{"plainuser", "wrong", false},
+		{"nosuchuser", "anything", false},
+	}
+	for _, c := range cases {
+		if got := a.Authenticate(c.user, c.pass); got != c.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", c.user, c.pass, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"os"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/pkg/errors"
+)
+
+// LogConf controls where and in what shape client log output is written.
+// It mirrors dumbproxy's CondLogger: a Sink selects the writer, Format
+// selects the encoding, and File is only consulted when Sink is "file".
+type LogConf struct {
+	Sink   string `json:"sink"`   // "stdout" (default), "json", or "file"
+	Format string `json:"format"` // "text" or "json"
+	File   string `json:"file"`   // path used when Sink == "file"
+}
+
+// setupLogSink wires cliConf's log configuration into the shared log
+// package so operators can redirect/structure logs without recompiling.
+func setupLogSink(conf LogConf) error {
+	var out *os.File
+	switch conf.Sink {
+	case "", "stdout":
+		out = os.Stdout
+	case "file":
+		if conf.File == "" {
+			return errors.New("log sink \"file\" requires a file path")
+		}
+		f, err := os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "open log file")
+		}
+		out = f
+	case "json":
+		out = os.Stdout
+		conf.Format = "json"
+	default:
+		return errors.Errorf("unknown log sink %q", conf.Sink)
+	}
+	log.SetOutput(out)
+	if conf.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	return nil
+}
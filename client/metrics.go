@@ -0,0 +1,117 @@
+package client
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricBytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lunnel",
+		Subsystem: "tunnel",
+		Name:      "bytes_in_total",
+		Help:      "total bytes read from the local service and forwarded upstream, by tunnel",
+	}, []string{"tunnel"})
+	metricBytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lunnel",
+		Subsystem: "tunnel",
+		Name:      "bytes_out_total",
+		Help:      "total bytes written to the local service, by tunnel",
+	}, []string{"tunnel"})
+	metricActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "lunnel",
+		Subsystem: "tunnel",
+		Name:      "active_streams",
+		Help:      "number of streams currently piping data, by tunnel",
+	}, []string{"tunnel"})
+	metricDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lunnel",
+		Subsystem: "tunnel",
+		Name:      "dial_failures_total",
+		Help:      "number of failed dials to the local service, by tunnel",
+	}, []string{"tunnel"})
+	metricPipeReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lunnel",
+		Subsystem: "client",
+		Name:      "pipe_reconnects_total",
+		Help:      "number of pipe (re)connect attempts to the server",
+	}, []string{"server_addr"})
+	metricPingRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "lunnel",
+		Subsystem: "client",
+		Name:      "ping_rtt_seconds",
+		Help:      "round trip time of control channel pings",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricPoolSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lunnel",
+		Subsystem: "pipe_pool",
+		Name:      "pipes",
+		Help:      "number of pipes currently held open in the pool",
+	})
+	metricPoolIdle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lunnel",
+		Subsystem: "pipe_pool",
+		Name:      "idle_pipes",
+		Help:      "number of pooled pipes with no active streams",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricBytesIn, metricBytesOut, metricActiveStreams, metricDialFailures,
+		metricPipeReconnects, metricPingRTT, metricPoolSize, metricPoolIdle)
+}
+
+// StartMetricsServer serves a Prometheus text exporter on addr until the
+// process exits. It is a no-op when addr is empty so operators who don't
+// want an admin endpoint pay nothing for it.
+func StartMetricsServer(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.WithFields(log.Fields{"addr": addr}).Infoln("serving metrics")
+		if err := http.Serve(lis, mux); err != nil {
+			log.WithFields(log.Fields{"addr": addr, "err": err}).Errorln("metrics server stopped")
+		}
+	}()
+	return nil
+}
+
+// countConn wraps a net.Conn dialed to a local service and updates the
+// per-tunnel byte counters as data flows through it, so dispatchStream's
+// io.Copy pairs don't need to know about metrics at all.
+type countConn struct {
+	net.Conn
+	tunnelName string
+}
+
+func newCountConn(conn net.Conn, tunnelName string) net.Conn {
+	return &countConn{Conn: conn, tunnelName: tunnelName}
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		metricBytesIn.WithLabelValues(c.tunnelName).Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		metricBytesOut.WithLabelValues(c.tunnelName).Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,334 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/longXboy/Lunnel/transport"
+)
+
+const (
+	defaultMinIdlePipes            = 1
+	defaultMaxPipes                = 8
+	defaultStreamsPerPipeThreshold = 32
+	defaultIdleGrace               = time.Minute * 2
+	defaultReapInterval            = time.Second * 30
+	defaultShutdownGrace           = time.Second * 10
+)
+
+// pooledPipe is one pre-warmed pipe session plus the bookkeeping the pool
+// needs to decide when it's safe to reap.
+type pooledPipe struct {
+	id       uint64
+	session  transport.Session
+	lastUsed time.Time
+}
+
+// pipePool keeps a small set of pre-warmed pipe sessions instead of
+// dialing one reactively per server TypePipeReq: it grows when the
+// busiest pipe's stream count crosses streamsPerPipeThreshold (up to
+// maxPipes) and reaps pipes that have sat idle past idleGrace (down to
+// minIdle), dialing new pipes through a BackoffHandler so a flaky path
+// to the server doesn't turn into a dial storm.
+type pipePool struct {
+	c *Control
+
+	mu    sync.Mutex
+	pipes map[uint64]*pooledPipe
+
+	nextID                  uint64
+	minIdle                 int
+	maxPipes                int
+	streamsPerPipeThreshold int
+	idleGrace               time.Duration
+
+	closed  bool
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newPipePool(c *Control) *pipePool {
+	return &pipePool{
+		c:                       c,
+		pipes:                   make(map[uint64]*pooledPipe),
+		minIdle:                 defaultMinIdlePipes,
+		maxPipes:                defaultMaxPipes,
+		streamsPerPipeThreshold: defaultStreamsPerPipeThreshold,
+		idleGrace:               defaultIdleGrace,
+		closeCh:                 make(chan struct{}),
+	}
+}
+
+// run starts the pool: it fills up to minIdle pipes and starts the
+// reaper and pinger. It should be called once, from Control.Run.
+func (p *pipePool) run() {
+	p.ensureMinIdle()
+	go p.reapLoop()
+	go p.pingLoop()
+}
+
+func (p *pipePool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pipes)
+}
+
+// ensureMinIdle tops the pool up to minIdle pipes, dialing whatever is
+// missing. Safe to call repeatedly - it's a no-op once the floor is met.
+func (p *pipePool) ensureMinIdle() {
+	for p.size() < p.minIdle {
+		if !p.dial() {
+			return
+		}
+	}
+}
+
+// growIfBusy opens one more pipe if the busiest pipe currently in the
+// pool is carrying more streams than the configured threshold and there
+// is still room under maxPipes.
+func (p *pipePool) growIfBusy() {
+	p.mu.Lock()
+	if len(p.pipes) >= p.maxPipes {
+		p.mu.Unlock()
+		return
+	}
+	busiest := 0
+	for _, pp := range p.pipes {
+		if n := pp.session.NumStreams(); n > busiest {
+			busiest = n
+		}
+	}
+	p.mu.Unlock()
+	if busiest > p.streamsPerPipeThreshold {
+		p.dial()
+	}
+}
+
+// dial opens one new pipe with exponential backoff on failure and adds it
+// to the pool. It returns false once the pool is closed, so callers can
+// stop retrying.
+func (p *pipePool) dial() bool {
+	p.wg.Add(1)
+	defer p.wg.Done()
+
+	backoff := BackoffHandler{BaseInterval: time.Second, MaxInterval: time.Second * 30}
+	for {
+		select {
+		case <-p.closeCh:
+			return false
+		default:
+		}
+
+		metricPipeReconnects.WithLabelValues(cliConf.ServerAddr).Inc()
+		conn, err := transport.CreateConn(cliConf.ServerAddr, p.c.transportMode, cliConf.HttpProxy)
+		if err != nil {
+			log.WithFields(log.Fields{"addr": cliConf.ServerAddr, "err": err}).Warningln("pipe pool: dial failed, backing off")
+			wait, ok := backoff.Backoff()
+			if !ok {
+				return false
+			}
+			select {
+			case <-time.After(wait):
+			case <-p.closeCh:
+				return false
+			}
+			continue
+		}
+
+		session, err := p.c.pipeHandShake(conn)
+		if err != nil {
+			conn.Close()
+			log.WithFields(log.Fields{"err": err}).Warningln("pipe pool: handshake failed, backing off")
+			wait, ok := backoff.Backoff()
+			if !ok {
+				return false
+			}
+			select {
+			case <-time.After(wait):
+			case <-p.closeCh:
+				return false
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			session.Close()
+			return false
+		}
+		id := p.nextID
+		p.nextID++
+		pp := &pooledPipe{id: id, session: session, lastUsed: time.Now()}
+		p.pipes[id] = pp
+		p.mu.Unlock()
+		metricPoolSize.Set(float64(p.size()))
+
+		p.wg.Add(1)
+		go p.acceptLoop(pp)
+		return true
+	}
+}
+
+// acceptLoop replaces the old per-pipe loop that used to live directly in
+// createPipe: it accepts streams off one pooled pipe until the pipe or
+// the control is closed, dispatching each stream to the local service.
+func (p *pipePool) acceptLoop(pp *pooledPipe) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pipes, pp.id)
+		p.mu.Unlock()
+		metricPoolSize.Set(float64(p.size()))
+		pp.session.Close()
+		p.ensureMinIdle()
+	}()
+
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		default:
+		}
+		if p.c.IsClosed() || pp.session.IsClosed() {
+			return
+		}
+		stream, err := pp.session.AcceptStream()
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "time": time.Now().Unix()}).Warningln("pipeAcceptStream failed!")
+			return
+		}
+		p.mu.Lock()
+		pp.lastUsed = time.Now()
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.c.dispatchStream(stream)
+		}()
+		p.growIfBusy()
+	}
+}
+
+// reapLoop closes pipes that have been idle past idleGrace, keeping the
+// pool no smaller than minIdle.
+func (p *pipePool) reapLoop() {
+	ticker := time.NewTicker(defaultReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reapIdle()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// pingLoop periodically samples round trip time on every pooled h2mux
+// pipe, which doubles as a keepalive that stops their idle timer from
+// expiring while no tunnel traffic is flowing.
+func (p *pipePool) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.pingH2MuxPipes()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+func (p *pipePool) pingH2MuxPipes() {
+	p.mu.Lock()
+	var sessions []*transport.H2MuxSession
+	for _, pp := range p.pipes {
+		if sess, ok := pp.session.(*transport.H2MuxSession); ok {
+			sessions = append(sessions, sess)
+		}
+	}
+	p.mu.Unlock()
+	for _, sess := range sessions {
+		if rtt, err := sess.Ping(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warningln("pipe pool: h2mux ping failed")
+		} else {
+			log.WithFields(log.Fields{"rtt": rtt}).Debugln("pipe pool: h2mux ping")
+		}
+	}
+}
+
+func (p *pipePool) reapIdle() {
+	p.mu.Lock()
+	idleCount := 0
+	var toReap []*pooledPipe
+	for _, pp := range p.pipes {
+		if pp.session.NumStreams() == 0 {
+			idleCount++
+			if len(p.pipes)-len(toReap) > p.minIdle && time.Since(pp.lastUsed) > p.idleGrace {
+				toReap = append(toReap, pp)
+			}
+		}
+	}
+	p.mu.Unlock()
+	metricPoolIdle.Set(float64(idleCount))
+	for _, pp := range toReap {
+		log.WithFields(log.Fields{"pipe_id": pp.id}).Debugln("pipe pool: reaping idle pipe")
+		pp.session.Close()
+	}
+}
+
+// drain performs a graceful shutdown of the pool: it stops growing or
+// reaping, gives in-flight streams up to grace to finish on their own
+// (tracked by wg, which acceptLoop and dispatchStream goroutines both
+// join), and only then force-closes whatever pipes are still open so the
+// call returns deterministically instead of blocking forever on a stuck
+// peer.
+//
+// A pipe with no active streams has its acceptLoop parked inside a
+// blocking AcceptStream call that closeCh alone can't wake, so idle
+// pipes are closed right away instead of waiting out the grace period
+// for traffic that will never arrive.
+func (p *pipePool) drain(grace time.Duration) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.closeCh)
+	var idle []*pooledPipe
+	for _, pp := range p.pipes {
+		if pp.session.NumStreams() == 0 {
+			idle = append(idle, pp)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, pp := range idle {
+		pp.session.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	log.WithFields(log.Fields{"grace": grace}).Warningln("pipe pool: grace period expired, closing remaining pipes")
+	p.mu.Lock()
+	for _, pp := range p.pipes {
+		pp.session.Close()
+	}
+	p.mu.Unlock()
+	<-done
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/longXboy/Lunnel/log"
+	"github.com/longXboy/Lunnel/msg"
+)
+
+// tunnelsOnlyConfig reloads just the [tunnels] section of the client's
+// config file on SIGHUP, so a live reload can't drift other cliConf
+// fields (server address, transport mode, ...) out from under an
+// in-flight control connection.
+type tunnelsOnlyConfig struct {
+	Tunnels map[string]msg.TunnelConfig `toml:"tunnels"`
+}
+
+// listenForReload re-reads cliConf.ConfigFile on SIGHUP and diffs its
+// tunnel names against what the server currently has synced for us,
+// adding tunnels with new names and removing those whose names are gone,
+// so tunnels that stay keep their active connections. A tunnel that keeps
+// its name is left as it is, even if its settings in the file changed.
+func (c *Control) listenForReload() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			c.reloadTunnels()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *Control) reloadTunnels() {
+	if cliConf.ConfigFile == "" {
+		log.Warningln("SIGHUP: no config file to reload tunnels from")
+		return
+	}
+	var reloaded tunnelsOnlyConfig
+	if _, err := toml.DecodeFile(cliConf.ConfigFile, &reloaded); err != nil {
+		log.WithFields(log.Fields{"err": err, "file": cliConf.ConfigFile}).Errorln("SIGHUP: reload config failed")
+		return
+	}
+
+	c.tunnelLock.Lock()
+	added := make(map[string]msg.TunnelConfig)
+	for name, tun := range reloaded.Tunnels {
+		if _, ok := c.tunnels[name]; !ok {
+			added[name] = tun
+		}
+	}
+	var removed []string
+	for name := range c.tunnels {
+		if _, ok := reloaded.Tunnels[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	c.tunnelLock.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		log.Infoln("SIGHUP: no tunnel changes")
+		return
+	}
+
+	if len(added) > 0 {
+		if err := msg.WriteMsg(c.ctlConn, msg.TypeAddTunnels, msg.AddTunnels{Tunnels: added}); err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("SIGHUP: send AddTunnels failed")
+		} else {
+			c.tunnelLock.Lock()
+			for name, tun := range added {
+				c.tunnels[name] = tun
+			}
+			c.tunnelLock.Unlock()
+		}
+	}
+	if len(removed) > 0 {
+		if err := msg.WriteMsg(c.ctlConn, msg.TypeDelTunnels, msg.DelTunnels{Names: removed}); err != nil {
+			log.WithFields(log.Fields{"err": err}).Errorln("SIGHUP: send DelTunnels failed")
+		} else {
+			c.tunnelLock.Lock()
+			for _, name := range removed {
+				delete(c.tunnels, name)
+			}
+			c.tunnelLock.Unlock()
+		}
+	}
+	log.WithFields(log.Fields{"added": len(added), "removed": len(removed)}).Infoln("SIGHUP: tunnels reloaded")
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/longXboy/Lunnel/msg"
+	"github.com/longXboy/Lunnel/transport"
+	"github.com/longXboy/Lunnel/util"
+)
+
+// serveHTTPTunnel replaces the raw net.Dial + io.Copy path for tunnels
+// whose Protocol is "http"/"https": it treats stream as a single accepted
+// HTTP connection and serves it through an httputil.ReverseProxy, so
+// requests get Host rewriting, X-Forwarded-* headers, and - if the
+// tunnel has an AuthFile configured - HTTP Basic auth in front of the
+// local service.
+func (c *Control) serveHTTPTunnel(stream transport.Stream, tunnel msg.TunnelConfig) {
+	localProto, hostname, port, err := util.ParseLocalAddr(tunnel.LocalAddr)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "local": tunnel.LocalAddr}).Errorln("util.ParseLocalAddr failed!")
+		return
+	}
+	if port == "" {
+		if tunnel.Protocol == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	if localProto == "" {
+		localProto = tunnel.Protocol
+	}
+
+	target := &url.URL{Scheme: localProto, Host: net.JoinHostPort(hostname, port)}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	localTransport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				metricDialFailures.WithLabelValues(stream.TunnelName()).Inc()
+				return nil, err
+			}
+			return newCountConn(conn, stream.TunnelName()), nil
+		},
+	}
+	if localProto == "https" {
+		localTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	proxy.Transport = localTransport
+	defaultDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		defaultDirector(req)
+		req.Host = target.Host
+		if clientIP, _, splitErr := net.SplitHostPort(req.RemoteAddr); splitErr == nil {
+			req.Header.Set("X-Forwarded-For", clientIP)
+			req.Header.Set("X-Real-IP", clientIP)
+		}
+		req.Header.Set("X-Forwarded-Proto", tunnel.Protocol)
+	}
+
+	var handler http.Handler = proxy
+	if tunnel.AuthFile != "" {
+		auth, err := getHtpasswdAuth(tunnel.AuthFile)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err, "auth_file": tunnel.AuthFile}).Errorln("loading tunnel auth file failed!")
+			return
+		}
+		handler = basicAuthHandler(auth, tunnel.AuthRealm, handler)
+	}
+
+	metricActiveStreams.WithLabelValues(stream.TunnelName()).Inc()
+	defer metricActiveStreams.WithLabelValues(stream.TunnelName()).Dec()
+
+	l := newSingleConnListener(stream)
+	srv := &http.Server{
+		Handler: handler,
+		// The listener only ever hands out one conn, so nothing will
+		// ever call Accept a second time to notice it's done; close the
+		// listener ourselves once that conn is closed so Serve returns
+		// instead of blocking forever on the next Accept.
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	srv.Serve(l)
+}
+
+func basicAuthHandler(auth *htpasswdAuth, realm string, next http.Handler) http.Handler {
+	if realm == "" {
+		realm = "restricted"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !auth.Authenticate(user, pass) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// singleConnListener adapts one already-established net.Conn into a
+// net.Listener with exactly one connection to hand out, so an
+// httputil.ReverseProxy can be served over a smux/h2mux stream via the
+// stdlib http.Server instead of a hand-rolled HTTP/1.1 parser.
+type singleConnListener struct {
+	conn    net.Conn
+	accept  chan net.Conn
+	closeCh chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conn:    conn,
+		accept:  make(chan net.Conn, 1),
+		closeCh: make(chan struct{}),
+	}
+	l.accept <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.accept:
+		if !ok {
+			return nil, fmt.Errorf("singleConnListener: closed")
+		}
+		return conn, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("singleConnListener: closed")
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	select {
+	case <-l.closeCh:
+	default:
+		close(l.closeCh)
+	}
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
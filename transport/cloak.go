@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/longXboy/Lunnel/crypto"
+	"github.com/longXboy/Lunnel/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// paddingExtensionType is the TLS "padding" extension (RFC 7685). Real
+// browsers use it to pad ClientHello to a size middleboxes won't choke
+// on, so a payload hidden inside it doesn't stand out to a passive
+// observer the way a bespoke extension type would.
+const paddingExtensionType uint16 = 21
+
+// cloakHiddenLen is the number of bytes of real handshake data (ClientID
+// + Once) smuggled inside the padding extension.
+const cloakHiddenLen = 32
+
+// CloakParams configures the disguised ClientHello used to open a
+// "cloak" pipe: on the wire it looks like a browser connecting to SNI,
+// while ClientID/Once/the ECDH public key ride inside fields a passive
+// observer expects to be opaque (session_id, padding extension).
+type CloakParams struct {
+	SNI          string
+	TemplatePath string
+	ClientID     crypto.UUID
+	Once         crypto.UUID
+}
+
+// ClientHelloTemplate captures the parts of a browser's ClientHello that
+// matter for JA3 fingerprinting: cipher suite list and extension order.
+// Loading one from disk lets operators mimic a specific browser instead
+// of Go's default, easily fingerprinted ClientHello shape.
+type ClientHelloTemplate struct {
+	CipherSuites    []uint16 `json:"cipher_suites"`
+	ExtensionsOrder []uint16 `json:"extensions_order"`
+}
+
+var defaultClientHelloTemplate = ClientHelloTemplate{
+	CipherSuites: []uint16{
+		0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+	},
+	ExtensionsOrder: []uint16{0x0000, 0x0017, 0x000d, 0x000a, 0x000b, 0x0023, paddingExtensionType},
+}
+
+func loadClientHelloTemplate(path string) (*ClientHelloTemplate, error) {
+	if path == "" {
+		tmpl := defaultClientHelloTemplate
+		return &tmpl, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read client hello template")
+	}
+	var tmpl ClientHelloTemplate
+	if err := json.Unmarshal(raw, &tmpl); err != nil {
+		return nil, errors.Wrap(err, "unmarshal client hello template")
+	}
+	return &tmpl, nil
+}
+
+// CloakHandshakeClient performs the disguised handshake over conn and
+// returns the 16-byte master key to hand to crypto.NewCryptoConn, so the
+// caller can fall back to the same smux-over-crypto pipe the encrypted
+// tcp/kcp modes use once this returns.
+//
+// Wire shape:
+//  1. we send a real-looking TLS 1.2 ClientHello: session_id carries our
+//     X25519 public key, a padding extension carries ClientID||Once;
+//  2. the server replies with a ServerHello whose session_id carries its
+//     X25519 public key, XORed with a pad derived from both randoms (the
+//     server random itself carries no key material), followed by a
+//     ChangeCipherSpec and Finished record (read and discarded - they
+//     exist only so the flow matches a real TLS handshake on the wire);
+//  3. both sides derive the same master key via HKDF over
+//     ClientHello.Random || ServerHello.Random, keyed by the X25519
+//     shared secret.
+func CloakHandshakeClient(conn net.Conn, params CloakParams) ([]byte, error) {
+	tmpl, err := loadClientHelloTemplate(params.TemplatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, priv, err := generateX25519KeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate x25519 keypair")
+	}
+
+	clientRandom := make([]byte, 32)
+	if _, err := rand.Read(clientRandom); err != nil {
+		return nil, errors.Wrap(err, "generate client random")
+	}
+
+	hidden := make([]byte, cloakHiddenLen)
+	copy(hidden[0:16], params.ClientID[:])
+	copy(hidden[16:32], params.Once[:])
+
+	clientHello := buildFakeClientHello(tmpl, params.SNI, clientRandom, pub, hidden)
+	if err := util.WriteTLSRecord(conn, util.TLSRecordHandshake, clientHello); err != nil {
+		return nil, errors.Wrap(err, "write fake client hello")
+	}
+
+	contentType, serverHello, err := util.ReadTLSRecord(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read fake server hello")
+	}
+	if contentType != util.TLSRecordHandshake {
+		return nil, errors.New("cloak: unexpected record type for server hello")
+	}
+	serverRandom, encryptedPeerPub, err := parseFakeServerHello(serverHello)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse fake server hello")
+	}
+	peerPub := xorBytes(encryptedPeerPub, deriveObfuscationPad(clientRandom, serverRandom))
+
+	// ChangeCipherSpec + Finished: consumed only to keep the on-wire
+	// record sequence indistinguishable from a genuine TLS handshake.
+	if _, _, err := util.ReadTLSRecord(conn); err != nil {
+		return nil, errors.Wrap(err, "read fake change cipher spec")
+	}
+	if _, _, err := util.ReadTLSRecord(conn); err != nil {
+		return nil, errors.Wrap(err, "read fake finished")
+	}
+
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, errors.Wrap(err, "curve25519.X25519")
+	}
+
+	masterKey := make([]byte, 16)
+	kdf := hkdf.New(sha256.New, shared, append(append([]byte{}, clientRandom...), serverRandom...), []byte("lunnel-cloak"))
+	if _, err := io.ReadFull(kdf, masterKey); err != nil {
+		return nil, errors.Wrap(err, "hkdf derive master key")
+	}
+	return masterKey, nil
+}
+
+func generateX25519KeyPair() (pub, priv []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, priv, nil
+}
+
+// buildFakeClientHello assembles a TLS 1.2 ClientHello handshake message
+// (handshake header + body) using the template's cipher suite and
+// extension order, with pub stashed in session_id and hidden stashed in
+// the padding extension.
+func buildFakeClientHello(tmpl *ClientHelloTemplate, sni string, clientRandom, pub, hidden []byte) []byte {
+	body := make([]byte, 0, 256)
+	body = append(body, 0x03, 0x03) // client_version: TLS 1.2
+	body = append(body, clientRandom...)
+	body = append(body, byte(len(pub)))
+	body = append(body, pub...) // session_id carries our real pubkey
+
+	cs := make([]byte, 2+2*len(tmpl.CipherSuites))
+	binary.BigEndian.PutUint16(cs, uint16(2*len(tmpl.CipherSuites)))
+	for i, suite := range tmpl.CipherSuites {
+		binary.BigEndian.PutUint16(cs[2+2*i:], suite)
+	}
+	body = append(body, cs...)
+	body = append(body, 0x01, 0x00) // compression methods: null only
+
+	var extensions []byte
+	for _, extType := range tmpl.ExtensionsOrder {
+		switch extType {
+		case 0x0000:
+			extensions = append(extensions, sniExtension(sni)...)
+		case paddingExtensionType:
+			extensions = append(extensions, paddingExtension(clientRandom, hidden)...)
+		default:
+			extensions = append(extensions, emptyExtension(extType)...)
+		}
+	}
+	extLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extLen, uint16(len(extensions)))
+	body = append(body, extLen...)
+	body = append(body, extensions...)
+
+	header := make([]byte, 4)
+	header[0] = 0x01 // handshake type: client_hello
+	putUint24(header[1:], uint32(len(body)))
+	return append(header, body...)
+}
+
+func sniExtension(name string) []byte {
+	nameBytes := []byte(name)
+	serverName := make([]byte, 3+len(nameBytes))
+	serverName[0] = 0x00 // host_name
+	binary.BigEndian.PutUint16(serverName[1:3], uint16(len(nameBytes)))
+	copy(serverName[3:], nameBytes)
+
+	list := make([]byte, 2+len(serverName))
+	binary.BigEndian.PutUint16(list[0:2], uint16(len(serverName)))
+	copy(list[2:], serverName)
+
+	return extensionTLV(0x0000, list)
+}
+
+// paddingExtension smuggles hidden (ClientID||Once) inside the padding
+// extension: it's XORed against a pad derived from the public
+// clientRandom, so the bytes look random rather than like the usual zero
+// padding, and a legitimate server can recover hidden from values it
+// already has rather than from the payload being hidden.
+func paddingExtension(clientRandom, hidden []byte) []byte {
+	obscured := xorBytes(hidden, deriveObfuscationPad(clientRandom, []byte("cloak-padding")))
+	return extensionTLV(paddingExtensionType, obscured)
+}
+
+func emptyExtension(extType uint16) []byte {
+	return extensionTLV(extType, nil)
+}
+
+func extensionTLV(extType uint16, data []byte) []byte {
+	out := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint16(out[0:2], extType)
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(data)))
+	copy(out[4:], data)
+	return out
+}
+
+// parseFakeServerHello pulls the server random and its encrypted ECDH
+// contribution back out of a ServerHello built the mirror-image way
+// buildFakeClientHello builds the ClientHello.
+func parseFakeServerHello(body []byte) (serverRandom, encryptedPeerPub []byte, err error) {
+	if len(body) < 4 {
+		return nil, nil, errors.New("server hello too short")
+	}
+	body = body[4:] // strip handshake header (type + 24-bit length)
+	if len(body) < 34 {
+		return nil, nil, errors.New("server hello body too short")
+	}
+	serverRandom = append([]byte{}, body[2:34]...)
+	sessionIDLen := int(body[34])
+	if len(body) < 35+sessionIDLen {
+		return nil, nil, errors.New("server hello session id truncated")
+	}
+	encryptedPeerPub = append([]byte{}, body[35:35+sessionIDLen]...)
+	return serverRandom, encryptedPeerPub, nil
+}
+
+func deriveObfuscationPad(a, b []byte) []byte {
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func xorBytes(data, pad []byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ pad[i%len(pad)]
+	}
+	return out
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
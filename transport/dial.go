@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+func newBufioReader(conn net.Conn) *bufio.Reader {
+	return bufio.NewReader(conn)
+}
+
+func dialKCP(addr string) (net.Conn, error) {
+	conn, err := kcp.DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+	conn.SetACKNoDelay(true)
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,478 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/longXboy/Lunnel/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	h2muxInitialWindow = 256 * 1024
+	h2muxIdleTimeout   = time.Minute * 2
+	// h2muxMaxFrameSize is the largest DATA payload written per frame.
+	// It's the RFC 7540 default SETTINGS_MAX_FRAME_SIZE, which every
+	// HTTP/2 peer accepts without negotiation, so writes larger than one
+	// frame are split into several frames even when the send window
+	// would allow more.
+	h2muxMaxFrameSize = 16 * 1024
+)
+
+// DialH2Mux dials addr over TLS with ALPN "h2" and starts an H2MuxSession
+// on top. It lets the client reach servers that sit behind strict L7
+// proxies/CDNs which only forward HTTPS: the wire looks like an ordinary
+// HTTP/2 connection, it just never talks to an http.Handler.
+func DialH2Mux(addr string, serverName string, httpProxy string) (*H2MuxSession, error) {
+	raw, err := CreateConn(addr, "tcp", httpProxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial raw conn")
+	}
+	tlsConn := tls.Client(raw, &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{"h2"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		raw.Close()
+		return nil, errors.Wrap(err, "tls handshake")
+	}
+	return newH2MuxSession(tlsConn, true)
+}
+
+// H2MuxSession multiplexes tunneled connections as HTTP/2 streams over a
+// single connection, the same way cloudflared's h2mux rides on top of
+// HTTP/2 framing: every tunneled connection becomes one stream, the
+// stream's tunnel name travels in a ":path" pseudo-header on the opening
+// HEADERS frame, and DATA frames carry the tunneled bytes.
+//
+// Unlike real HTTP/2, either end may open a stream at any time - lunnel's
+// pipes are full duplex, there's no fixed client/server request/response
+// role once the preface and SETTINGS are exchanged.
+type H2MuxSession struct {
+	conn     net.Conn
+	framer   *http2.Framer
+	hdec     *hpack.Decoder
+	isDialer bool
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*H2MuxStream
+	nextID  uint32
+	closed  bool
+
+	acceptCh chan *H2MuxStream
+	closeCh  chan struct{}
+
+	pingMu   sync.Mutex
+	pingSent time.Time
+	lastRTT  time.Duration
+}
+
+func newH2MuxSession(conn net.Conn, isDialer bool) (*H2MuxSession, error) {
+	s := &H2MuxSession{
+		conn:     conn,
+		isDialer: isDialer,
+		streams:  make(map[uint32]*H2MuxStream),
+		acceptCh: make(chan *H2MuxStream, 32),
+		closeCh:  make(chan struct{}),
+	}
+	s.framer = http2.NewFramer(conn, conn)
+	s.hdec = hpack.NewDecoder(4096, nil)
+	if isDialer {
+		s.nextID = 1
+		if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+			return nil, errors.Wrap(err, "write client preface")
+		}
+	} else {
+		s.nextID = 2
+		buf := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, errors.Wrap(err, "read client preface")
+		}
+		if string(buf) != http2.ClientPreface {
+			return nil, errors.New("invalid http2 client preface")
+		}
+	}
+	if err := s.framer.WriteSettings(); err != nil {
+		return nil, errors.Wrap(err, "write initial settings")
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// NewH2MuxServer adapts an already-accepted connection (one where we read
+// the preface rather than wrote it) into an H2MuxSession, for use on the
+// pipe-accepting side.
+func NewH2MuxServer(conn net.Conn) (*H2MuxSession, error) {
+	return newH2MuxSession(conn, false)
+}
+
+// NewH2MuxClient adapts a connection this side dialed (so it owns the
+// preface) into an H2MuxSession. lunnel's client dials the pipe but still
+// wants to accept streams the server opens on it, which h2mux allows
+// since either end may call OpenStream/AcceptStream once set up.
+func NewH2MuxClient(conn net.Conn) (*H2MuxSession, error) {
+	return newH2MuxSession(conn, true)
+}
+
+func (s *H2MuxSession) allocStreamID() uint32 {
+	id := s.nextID
+	s.nextID += 2
+	return id
+}
+
+func (s *H2MuxSession) OpenStream(tunnelName string) (Stream, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errors.New("session closed")
+	}
+	id := s.allocStreamID()
+	st := newH2MuxStream(id, tunnelName, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	var headerBuf bytes.Buffer
+	hpack.NewEncoder(&headerBuf).WriteField(hpack.HeaderField{Name: ":path", Value: tunnelName})
+
+	s.writeMu.Lock()
+	err := s.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: headerBuf.Bytes(),
+		EndHeaders:    true,
+	})
+	s.writeMu.Unlock()
+	if err != nil {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+		return nil, errors.Wrap(err, "write headers frame")
+	}
+	return st, nil
+}
+
+func (s *H2MuxSession) AcceptStream() (Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closeCh:
+		return nil, errors.New("session closed")
+	}
+}
+
+func (s *H2MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *H2MuxSession) IsClosed() bool {
+	select {
+	case <-s.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *H2MuxSession) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closeCh)
+	streams := make([]*H2MuxStream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.mu.Unlock()
+	// Fail pending reads so goroutines copying out of a stream don't
+	// block forever once the connection underneath is gone.
+	for _, st := range streams {
+		st.pw.CloseWithError(errors.New("session closed"))
+	}
+	return s.conn.Close()
+}
+
+// Ping samples round trip time over the mux connection using an HTTP/2
+// PING frame, mirroring the RTT sampling the smux/kcp path gets from its
+// own keepalive. It returns the RTT measured for the previous PING (zero
+// until one has been acknowledged); this PING's RTT is recorded by
+// readLoop when its ACK arrives.
+func (s *H2MuxSession) Ping() (time.Duration, error) {
+	var payload [8]byte
+	s.pingMu.Lock()
+	s.pingSent = time.Now()
+	s.pingMu.Unlock()
+	s.writeMu.Lock()
+	err := s.framer.WritePing(false, payload)
+	s.writeMu.Unlock()
+	if err != nil {
+		return 0, errors.Wrap(err, "write ping frame")
+	}
+	return s.lastRTT, nil
+}
+
+func (s *H2MuxSession) readLoop() {
+	defer s.Close()
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(h2muxIdleTimeout))
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Debugln("h2mux readLoop stopped")
+			return
+		}
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			s.handleHeaders(f)
+		case *http2.DataFrame:
+			s.handleData(f)
+		case *http2.RSTStreamFrame:
+			s.handleReset(f.StreamID)
+		case *http2.WindowUpdateFrame:
+			s.handleWindowUpdate(f)
+		case *http2.PingFrame:
+			s.handlePing(f)
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				s.writeMu.Lock()
+				s.framer.WriteSettingsAck()
+				s.writeMu.Unlock()
+			}
+		case *http2.GoAwayFrame:
+			return
+		}
+	}
+}
+
+func (s *H2MuxSession) handleHeaders(f *http2.HeadersFrame) {
+	fields, err := s.hdec.DecodeFull(f.HeaderBlockFragment())
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warningln("h2mux decode headers failed")
+		return
+	}
+	var tunnelName string
+	for _, hf := range fields {
+		if hf.Name == ":path" {
+			tunnelName = hf.Value
+		}
+	}
+	st := newH2MuxStream(f.StreamID, tunnelName, s)
+	s.mu.Lock()
+	s.streams[f.StreamID] = st
+	s.mu.Unlock()
+	select {
+	case s.acceptCh <- st:
+	case <-s.closeCh:
+	}
+}
+
+func (s *H2MuxSession) handleData(f *http2.DataFrame) {
+	s.mu.Lock()
+	st, ok := s.streams[f.StreamID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	var data []byte
+	if len(f.Data()) > 0 {
+		// f.Data() is only valid until the next ReadFrame call, but
+		// st.deliverLoop consumes it asynchronously, so it must be copied.
+		data = append([]byte(nil), f.Data()...)
+	}
+	select {
+	case st.dataCh <- h2muxChunk{data: data, end: f.StreamEnded()}:
+	case <-s.closeCh:
+	}
+}
+
+// sendWindowUpdate tells the peer it may send n more bytes, both for the
+// given stream and for the connection as a whole.
+func (s *H2MuxSession) sendWindowUpdate(streamID uint32, n int) {
+	if n <= 0 {
+		return
+	}
+	s.writeMu.Lock()
+	s.framer.WriteWindowUpdate(streamID, uint32(n))
+	s.framer.WriteWindowUpdate(0, uint32(n))
+	s.writeMu.Unlock()
+}
+
+func (s *H2MuxSession) handleReset(id uint32) {
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+	if ok {
+		st.closeInput()
+		st.pw.CloseWithError(errors.New("stream reset by peer"))
+	}
+}
+
+func (s *H2MuxSession) handleWindowUpdate(f *http2.WindowUpdateFrame) {
+	if f.StreamID == 0 {
+		return
+	}
+	s.mu.Lock()
+	st, ok := s.streams[f.StreamID]
+	s.mu.Unlock()
+	if ok {
+		st.addSendWindow(int32(f.Increment))
+	}
+}
+
+func (s *H2MuxSession) handlePing(f *http2.PingFrame) {
+	if f.IsAck() {
+		s.pingMu.Lock()
+		if !s.pingSent.IsZero() {
+			s.lastRTT = time.Since(s.pingSent)
+		}
+		s.pingMu.Unlock()
+		return
+	}
+	s.writeMu.Lock()
+	s.framer.WritePing(true, f.Data)
+	s.writeMu.Unlock()
+}
+
+func (s *H2MuxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// h2muxChunk is one DATA frame's payload handed from readLoop to a
+// stream's deliverLoop, in order.
+type h2muxChunk struct {
+	data []byte
+	end  bool
+}
+
+// H2MuxStream is a single tunneled connection riding one HTTP/2 stream.
+// Inbound DATA frames are queued on dataCh and fed into pw/pr by
+// deliverLoop, so one stream with a slow consumer blocks only its own
+// goroutine rather than the session's shared readLoop. Outbound writes
+// become DATA frames gated by a simple send window that's replenished by
+// WindowUpdateFrames the peer sends as it drains its own queue.
+type H2MuxStream struct {
+	id         uint32
+	tunnelName string
+	sess       *H2MuxSession
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	dataCh         chan h2muxChunk
+	inputCloseOnce sync.Once
+
+	windowMu sync.Mutex
+	windowCv *sync.Cond
+	window   int32
+
+	closeOnce sync.Once
+}
+
+func newH2MuxStream(id uint32, tunnelName string, sess *H2MuxSession) *H2MuxStream {
+	pr, pw := io.Pipe()
+	st := &H2MuxStream{
+		id:         id,
+		tunnelName: tunnelName,
+		sess:       sess,
+		pr:         pr,
+		pw:         pw,
+		dataCh:     make(chan h2muxChunk, 32),
+		window:     h2muxInitialWindow,
+	}
+	st.windowCv = sync.NewCond(&st.windowMu)
+	go st.deliverLoop()
+	return st
+}
+
+// deliverLoop writes queued DATA payloads into pw in order, off the
+// session's readLoop goroutine, and replenishes the peer's send window
+// once each chunk has actually been consumed by the Read side.
+func (st *H2MuxStream) deliverLoop() {
+	for chunk := range st.dataCh {
+		if len(chunk.data) > 0 {
+			n, err := st.pw.Write(chunk.data)
+			if err == nil {
+				st.sess.sendWindowUpdate(st.id, n)
+			}
+		}
+		if chunk.end {
+			st.pw.Close()
+			return
+		}
+	}
+}
+
+func (st *H2MuxStream) closeInput() {
+	st.inputCloseOnce.Do(func() { close(st.dataCh) })
+}
+
+func (st *H2MuxStream) TunnelName() string { return st.tunnelName }
+
+func (st *H2MuxStream) Read(p []byte) (int, error) { return st.pr.Read(p) }
+
+func (st *H2MuxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.windowMu.Lock()
+		for st.window <= 0 {
+			st.windowCv.Wait()
+		}
+		n := len(p) - written
+		if int32(n) > st.window {
+			n = int(st.window)
+		}
+		if n > h2muxMaxFrameSize {
+			n = h2muxMaxFrameSize
+		}
+		st.window -= int32(n)
+		st.windowMu.Unlock()
+
+		st.sess.writeMu.Lock()
+		err := st.sess.framer.WriteData(st.id, false, p[written:written+n])
+		st.sess.writeMu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (st *H2MuxStream) addSendWindow(n int32) {
+	st.windowMu.Lock()
+	st.window += n
+	st.windowMu.Unlock()
+	st.windowCv.Broadcast()
+}
+
+func (st *H2MuxStream) Close() error {
+	st.closeOnce.Do(func() {
+		st.sess.writeMu.Lock()
+		st.sess.framer.WriteRSTStream(st.id, http2.ErrCodeCancel)
+		st.sess.writeMu.Unlock()
+		st.sess.removeStream(st.id)
+		st.closeInput()
+		st.pr.Close()
+		st.pw.Close()
+	})
+	return nil
+}
+
+func (st *H2MuxStream) LocalAddr() net.Addr                { return st.sess.conn.LocalAddr() }
+func (st *H2MuxStream) RemoteAddr() net.Addr               { return st.sess.conn.RemoteAddr() }
+func (st *H2MuxStream) SetDeadline(t time.Time) error      { return nil }
+func (st *H2MuxStream) SetReadDeadline(t time.Time) error  { return nil }
+func (st *H2MuxStream) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestH2MuxFlowControlLargeTransfer sends more than one stream window's
+// worth of data over a single h2mux stream and checks it arrives intact,
+// guarding against the receiving stream's deliverLoop forgetting to
+// replenish the peer's send window once it's exhausted.
+func TestH2MuxFlowControlLargeTransfer(t *testing.T) {
+	// A loopback TCP pair rather than net.Pipe: both ends write their
+	// SETTINGS frame before either starts reading, which needs a conn that
+	// buffers writes.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	type sessResult struct {
+		sess *H2MuxSession
+		err  error
+	}
+	clientDone := make(chan sessResult, 1)
+	serverDone := make(chan sessResult, 1)
+	go func() {
+		s, err := newH2MuxSession(clientConn, true)
+		clientDone <- sessResult{s, err}
+	}()
+	go func() {
+		s, err := newH2MuxSession(serverConn, false)
+		serverDone <- sessResult{s, err}
+	}()
+
+	clientRes := <-clientDone
+	if clientRes.err != nil {
+		t.Fatalf("client newH2MuxSession: %v", clientRes.err)
+	}
+	serverRes := <-serverDone
+	if serverRes.err != nil {
+		t.Fatalf("server newH2MuxSession: %v", serverRes.err)
+	}
+	defer clientRes.sess.Close()
+	defer serverRes.sess.Close()
+
+	openDone := make(chan error, 1)
+	var clientStream Stream
+	go func() {
+		s, err := clientRes.sess.OpenStream("test-tunnel")
+		clientStream = s
+		openDone <- err
+	}()
+	acceptDone := make(chan error, 1)
+	var serverStream Stream
+	go func() {
+		s, err := serverRes.sess.AcceptStream()
+		serverStream = s
+		acceptDone <- err
+	}()
+	if err := <-openDone; err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if err := <-acceptDone; err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	payload := make([]byte, h2muxInitialWindow*3)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := clientStream.Write(payload)
+		writeDone <- err
+	}()
+
+	received := make([]byte, len(payload))
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(serverStream, received)
+		readDone <- err
+	}()
+
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not complete in time - send window never replenished")
+	}
+
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not complete in time")
+	}
+
+	if !bytes.Equal(received, payload) {
+		t.Fatal("received payload does not match what was written")
+	}
+}
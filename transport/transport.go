@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Session is the common interface the client's Control speaks regardless
+// of which transport mode carries the pipe: smux over raw TCP/KCP, or the
+// HTTP/2-framed h2mux. It lets the client's pipe pool and pipeHandShake
+// stay transport agnostic past the initial dial.
+type Session interface {
+	OpenStream(tunnelName string) (Stream, error)
+	AcceptStream() (Stream, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+// Stream is a single tunneled connection multiplexed over a Session. It is
+// a plain net.Conn plus the tunnel name it was opened/accepted for.
+type Stream interface {
+	net.Conn
+	TunnelName() string
+}
+
+// CreateConn dials addr using the given transport mode, optionally through
+// an HTTP CONNECT proxy. When httpProxy is set every mode dials through
+// the proxy; otherwise "kcp" dials over KCP and every other mode ("tcp",
+// "h2mux", "cloak") dials plain TCP.
+func CreateConn(addr string, mode string, httpProxy string) (net.Conn, error) {
+	if httpProxy != "" {
+		return dialViaHttpProxy(addr, httpProxy)
+	}
+	switch mode {
+	case "kcp":
+		return dialKCP(addr)
+	default:
+		conn, err := net.DialTimeout("tcp", addr, time.Second*8)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.DialTimeout")
+		}
+		return conn, nil
+	}
+}
+
+func dialViaHttpProxy(addr string, httpProxy string) (net.Conn, error) {
+	proxyUrl, err := url.Parse(httpProxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "url.Parse httpProxy")
+	}
+	conn, err := net.DialTimeout("tcp", proxyUrl.Host, time.Second*8)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.DialTimeout proxy")
+	}
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "write CONNECT request")
+	}
+	resp, err := http.ReadResponse(newBufioReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "read CONNECT response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+	return conn, nil
+}
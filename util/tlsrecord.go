@@ -0,0 +1,53 @@
+package util
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// TLS record content types, as needed by transports that speak raw TLS
+// framing without going through crypto/tls (e.g. a disguised handshake).
+const (
+	TLSRecordHandshake    byte = 22
+	TLSRecordChangeCipher byte = 20
+	tlsRecordHeaderLen         = 5
+	tlsRecordMaxLen            = 1 << 14
+)
+
+// ReadTLSRecord reads one length-prefixed TLS record off conn and returns
+// its content type and payload, without interpreting the payload itself.
+// It exists so transports can consume a handful of raw TLS records (a
+// ServerHello, a ChangeCipherSpec, a Finished) without depending on
+// crypto/tls's stateful handshake machinery.
+func ReadTLSRecord(conn net.Conn) (contentType byte, payload []byte, err error) {
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return 0, nil, errors.Wrap(err, "read tls record header")
+	}
+	length := binary.BigEndian.Uint16(header[3:5])
+	if length > tlsRecordMaxLen {
+		return 0, nil, errors.New("tls record too large")
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(conn, payload); err != nil {
+		return 0, nil, errors.Wrap(err, "read tls record payload")
+	}
+	return header[0], payload, nil
+}
+
+// WriteTLSRecord frames payload as a single TLS record of the given
+// content type using protocol version TLS 1.2 (0x03, 0x03).
+func WriteTLSRecord(conn net.Conn, contentType byte, payload []byte) error {
+	header := make([]byte, tlsRecordHeaderLen)
+	header[0] = contentType
+	header[1] = 0x03
+	header[2] = 0x03
+	binary.BigEndian.PutUint16(header[3:5], uint16(len(payload)))
+	if _, err := conn.Write(append(header, payload...)); err != nil {
+		return errors.Wrap(err, "write tls record")
+	}
+	return nil
+}